@@ -6,9 +6,13 @@ package safepath
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // A Rules is a set of restrictions for file names. Rules are bitflags, and
@@ -16,7 +20,7 @@ import (
 //
 // For example, URLUnescaped | NotHidden rejects any paths which either require
 // escaping in URLs or which contain a path segment that starts with ".".
-type Rules uint8
+type Rules uint16
 
 const (
 	// Any allows any path which can be used on lax systems like Linux.
@@ -65,6 +69,26 @@ const (
 	WindowsSafe
 	// NotHidden requires that paths do not start with a period.
 	NotHidden
+	// WindowsLocal requires that paths do not reach into the Windows
+	// DosDevices namespace.
+	//
+	// This rejects segments "?" and "??", which name the root of the
+	// namespace reachable through the "\\?\" and "\??\" local device path
+	// prefixes. When combined with WindowsSafe, it also rejects segments
+	// that start with "\\", since consumers that join segments with
+	// backslashes could otherwise reconstruct a "\\?\" or "\\.\" prefix.
+	WindowsLocal
+	// NormalizedUnicode requires that paths use an unambiguous, normalized
+	// representation of Unicode text.
+	//
+	// This rejects runes from categories that cause ambiguity in file names:
+	// format controls (Cf, including bidirectional overrides and joiners),
+	// private-use characters (Co), unassigned code points (Cn), modifier
+	// symbols (Sk), and a non-spacing mark (Mn) at the start of a segment,
+	// where it has no base character to combine with. It also requires that
+	// each segment already be in Unicode Normalized Form C (NFC), so that
+	// visually-identical names cannot differ by combining-sequence encoding.
+	NormalizedUnicode
 	// always are rules that always apply. Used to filter out / and null byte.
 	always
 )
@@ -76,7 +100,7 @@ const (
 	// it allows only paths that follow all of the rulesets defined in this
 	// library, and any future rulesets added to the libary will likely be added
 	// to Strict.
-	Strict = ASCIIOnly | ValidUTF8 | URLUnescaped | ShellSafe | ArgumentSafe | WindowsSafe | NotHidden
+	Strict = ASCIIOnly | ValidUTF8 | URLUnescaped | ShellSafe | ArgumentSafe | WindowsSafe | NotHidden | WindowsLocal | NormalizedUnicode
 )
 
 // GoString implements the GoStringer interface.
@@ -103,7 +127,13 @@ func (r Rules) GoString() string {
 	if r&NotHidden != 0 {
 		s = append(s, "NotHidden")
 	}
-	rem := r &^ (ASCIIOnly | ValidUTF8 | URLUnescaped | ShellSafe | ArgumentSafe | WindowsSafe | NotHidden)
+	if r&WindowsLocal != 0 {
+		s = append(s, "WindowsLocal")
+	}
+	if r&NormalizedUnicode != 0 {
+		s = append(s, "NormalizedUnicode")
+	}
+	rem := r &^ (ASCIIOnly | ValidUTF8 | URLUnescaped | ShellSafe | ArgumentSafe | WindowsSafe | NotHidden | WindowsLocal | NormalizedUnicode)
 	if rem == 0 {
 		if len(s) == 0 {
 			return "Any"
@@ -174,6 +204,86 @@ func init() {
 	}
 }
 
+// windowsSuperscriptDigit maps the superscript digits that Windows
+// normalizes to plain ASCII digits when resolving DOS device names
+// (U+00B9, U+00B2, U+00B3) to the digit they represent.
+var windowsSuperscriptDigit = map[rune]byte{
+	'¹': '1',
+	'²': '2',
+	'³': '3',
+}
+
+// windowsReservedBase reports whether base names a reserved Windows device,
+// after stripping trailing spaces and normalizing a trailing superscript
+// digit (as in "COM²") to its plain digit. canonical is the lowercase
+// reserved name that was matched; normalized reports whether base had to be
+// altered to find the match.
+func windowsReservedBase(base string) (canonical string, normalized bool, ok bool) {
+	trimmed := strings.TrimRight(base, " ")
+	lower := strings.ToLower(trimmed)
+	if windowsReserved[lower] {
+		return lower, trimmed != base, true
+	}
+	for _, prefix := range [...]string{"com", "lpt"} {
+		if !strings.HasPrefix(lower, prefix) {
+			continue
+		}
+		rest := trimmed[len(prefix):]
+		r, size := utf8.DecodeRuneInString(rest)
+		if size != len(rest) {
+			continue
+		}
+		if digit, ok := windowsSuperscriptDigit[r]; ok {
+			return prefix + string(rune(digit)), true, true
+		}
+	}
+	return "", false, false
+}
+
+// isBidiControl reports whether r is one of the explicit bidirectional
+// formatting controls that can be used to disguise a file name: the
+// embeddings and overrides U+202A-U+202E, and the isolates U+2066-U+2069.
+func isBidiControl(r rune) bool {
+	return (r >= 0x202a && r <= 0x202e) || (r >= 0x2066 && r <= 0x2069)
+}
+
+// isUnassignedRune reports whether r does not belong to any assigned
+// Unicode general category, i.e. category Cn.
+func isUnassignedRune(r rune) bool {
+	for _, t := range unicode.Categories {
+		if unicode.Is(t, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkNormalizedUnicode returns an error if name contains a rune from a
+// Unicode category that causes ambiguity in file names, or if name is not
+// already in Normalization Form C.
+func checkNormalizedUnicode(name string) error {
+	for i, c := range name {
+		switch {
+		case isBidiControl(c):
+			return &Error{name: name, err: errUnicodeClass, char: c, class: "a bidirectional control"}
+		case unicode.Is(unicode.Cf, c):
+			return &Error{name: name, err: errUnicodeClass, char: c, class: "a format (Cf)"}
+		case unicode.Is(unicode.Co, c):
+			return &Error{name: name, err: errUnicodeClass, char: c, class: "a private-use (Co)"}
+		case unicode.Is(unicode.Sk, c):
+			return &Error{name: name, err: errUnicodeClass, char: c, class: "a modifier symbol (Sk)"}
+		case i == 0 && unicode.Is(unicode.Mn, c):
+			return &Error{name: name, err: errUnicodeClass, char: c, class: "an unattached non-spacing mark (Mn)"}
+		case isUnassignedRune(c):
+			return &Error{name: name, err: errUnicodeClass, char: c, class: "an unassigned (Cn)"}
+		}
+	}
+	if !norm.NFC.IsNormalString(name) {
+		return &Error{name: name, err: errNotNFC}
+	}
+	return nil
+}
+
 const (
 	// Path segment errors.
 	errBad = iota
@@ -183,12 +293,21 @@ const (
 	errInvalidUTF8
 	errNonASCII
 	errWReserved
+	errWReservedNorm
+	errWLocalDevice
+	errUnicodeClass
+	errNotNFC
 
 	// Path errors.
 	errEmpty
 	errAbsolute
 	errTrailingSlash
 	errDoubleSlash
+	errCaseCollision
+	errDuplicate
+	errDriveLetter
+	errAltStream
+	errParentChild
 )
 
 // An Error indicates that a path is considered unsafe.
@@ -200,6 +319,8 @@ type Error struct {
 	byte   byte
 	char   rune
 	base   string
+	other  string
+	class  string
 }
 
 func (e *Error) Error() string {
@@ -226,6 +347,14 @@ func (e *Error) Error() string {
 		}
 	case errWReserved:
 		msg = fmt.Sprintf("uses reserved Windows filename %q", e.base)
+	case errWReservedNorm:
+		msg = fmt.Sprintf("base %q normalizes to reserved Windows filename %q", e.other, e.base)
+	case errWLocalDevice:
+		msg = "can reach into the Windows DosDevices namespace"
+	case errUnicodeClass:
+		msg = fmt.Sprintf("contains %s character %q U+%04X", e.class, e.char, e.char)
+	case errNotNFC:
+		msg = "is not normalized to Unicode Normalization Form C (NFC)"
 	case errEmpty:
 		msg = "path is empty"
 	case errAbsolute:
@@ -234,10 +363,20 @@ func (e *Error) Error() string {
 		msg = "path has trailing slash"
 	case errDoubleSlash:
 		msg = "path has double slash"
+	case errCaseCollision:
+		msg = fmt.Sprintf("case-insensitive collision with %q", e.other)
+	case errDuplicate:
+		msg = fmt.Sprintf("duplicate of %q", e.other)
+	case errDriveLetter:
+		msg = "path begins with a drive letter"
+	case errAltStream:
+		msg = fmt.Sprintf("segment %q contains NTFS alternate data stream syntax", e.name)
+	case errParentChild:
+		msg = fmt.Sprintf("is both a file and a directory prefix of %q", e.other)
 	default:
 		panic("invalid safepath.Error")
 	}
-	if e.err <= errWReserved {
+	if e.err <= errNotNFC {
 		prefix := fmt.Sprintf("invalid path segment %q", e.name)
 		if msg != "" {
 			msg = prefix + ": " + msg
@@ -276,6 +415,18 @@ func (r Rules) CheckPathSegment(name string) error {
 			rest = rest[n:]
 		}
 	}
+	if r&WindowsLocal != 0 {
+		// These checks must run before the generic disallowed-byte scan
+		// below, which would otherwise reject "?" and "\\" as plain
+		// WindowsSafe violations (errAny) and never report the more
+		// specific DosDevices-namespace error.
+		if name == "?" || name == "??" {
+			return &Error{name: name, err: errWLocalDevice}
+		}
+		if r&WindowsSafe != 0 && strings.HasPrefix(name, `\\`) {
+			return &Error{name: name, err: errWLocalDevice}
+		}
+	}
 	for i, c := range []byte(name) {
 		f := flags[c]
 		if f&r != r {
@@ -308,11 +459,11 @@ func (r Rules) CheckPathSegment(name string) error {
 			if i != -1 {
 				base = name[:i]
 			}
-			if len(base) == 3 || len(base) == 4 {
-				base = strings.ToLower(base)
-				if windowsReserved[base] {
-					return &Error{name: name, err: errWReserved, base: base}
+			if canonical, normalized, ok := windowsReservedBase(base); ok {
+				if normalized {
+					return &Error{name: name, err: errWReservedNorm, base: canonical, other: base}
 				}
+				return &Error{name: name, err: errWReserved, base: canonical}
 			}
 		}
 	}
@@ -321,6 +472,11 @@ func (r Rules) CheckPathSegment(name string) error {
 			return &Error{name: name, err: errFirst, char: first}
 		}
 	}
+	if r&NormalizedUnicode != 0 {
+		if err := checkNormalizedUnicode(name); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -366,3 +522,271 @@ func (r Rules) CheckPath(name string) error {
 	}
 	return nil
 }
+
+// CheckPathSet returns an error if any path in paths is unsafe according to
+// CheckPath, if the same path is listed more than once, or if two distinct
+// paths are equal after conversion to lower case with strings.ToLower. Runes
+// that fold together without sharing a lower-case form, such as "s" and "ſ"
+// (U+017F), are not treated as colliding.
+//
+// This guards against the same hazard as Go's module zip packing: on
+// case-insensitive filesystems such as Windows and macOS, two paths which
+// differ only in case collide even though each one is individually safe.
+func (r Rules) CheckPathSet(paths []string) error {
+	seen := make(map[string]string, len(paths))
+	for _, path := range paths {
+		if err := r.CheckPath(path); err != nil {
+			return err
+		}
+		fold := strings.ToLower(path)
+		if other, ok := seen[fold]; ok {
+			if other == path {
+				return &Error{isPath: true, path: path, err: errDuplicate, other: other}
+			}
+			return &Error{isPath: true, path: path, err: errCaseCollision, other: other}
+		}
+		seen[fold] = path
+	}
+	return nil
+}
+
+// DefaultReplacement is the rune that SanitizePathSegment and SanitizePath
+// substitute for disallowed bytes.
+const DefaultReplacement = '_'
+
+// maxSegmentBytes is the length, in bytes, that SanitizePathSegment
+// truncates a segment to.
+const maxSegmentBytes = 255
+
+// SanitizePathSegment transforms name into a safe path segment under the
+// receiver's rules, using DefaultReplacement in place of disallowed bytes.
+// It returns the cleaned segment and whether any change was made.
+//
+// The WindowsLocal and NormalizedUnicode rules are not applied: a segment
+// that only they reject, such as "?" under WindowsLocal alone or a segment
+// that is not in NFC under NormalizedUnicode alone, is returned unchanged
+// and still fails CheckPathSegment.
+//
+// Unlike CheckPathSegment, SanitizePathSegment never fails: a segment which
+// cannot be repaired, such as "", ".", or "..", sanitizes to "". Callers
+// composing a path from sanitized segments should drop any segment that
+// comes back empty.
+func (r Rules) SanitizePathSegment(name string) (string, bool) {
+	return r.SanitizePathSegmentWith(name, DefaultReplacement)
+}
+
+// SanitizePathSegmentWith is like SanitizePathSegment, but substitutes
+// replacement for disallowed bytes instead of DefaultReplacement.
+func (r Rules) SanitizePathSegmentWith(name string, replacement rune) (string, bool) {
+	orig := name
+	if name == "" || name == "." || name == ".." {
+		return "", orig != ""
+	}
+	rr := (r & Strict) | always
+
+	// Replace bytes which make the segment invalid UTF-8.
+	if rr&(ASCIIOnly|ValidUTF8) == ValidUTF8 {
+		var b strings.Builder
+		b.Grow(len(name))
+		rest := name
+		for len(rest) != 0 {
+			c, n := utf8.DecodeRuneInString(rest)
+			if c == utf8.RuneError && n == 1 {
+				b.WriteRune(replacement)
+			} else {
+				b.WriteString(rest[:n])
+			}
+			rest = rest[n:]
+		}
+		name = b.String()
+	}
+
+	// Replace bytes disallowed by the rules.
+	{
+		var b strings.Builder
+		b.Grow(len(name))
+		for i := 0; i < len(name); i++ {
+			c := name[i]
+			if flags[c]&rr != rr {
+				b.WriteRune(replacement)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+		name = b.String()
+	}
+
+	// Strip leading characters that are disallowed only in that position.
+	for len(name) != 0 {
+		first, size := utf8.DecodeRuneInString(name)
+		strip := (rr&ShellSafe != 0 && first == '~') ||
+			(rr&ArgumentSafe != 0 && first == '-') ||
+			(rr&NotHidden != 0 && first == '.')
+		if !strip {
+			break
+		}
+		name = name[size:]
+	}
+
+	name = truncateUTF8(name, maxSegmentBytes)
+
+	if rr&WindowsSafe != 0 {
+		// Strip trailing dots and spaces. This must run after truncation,
+		// since truncating to maxSegmentBytes can itself expose a trailing
+		// '.' or ' ' that the untruncated name didn't end with.
+		name = strings.TrimRight(name, ". ")
+		// Prefix reserved device names so they no longer match.
+		base := name
+		if i := strings.IndexByte(name, '.'); i != -1 {
+			base = name[:i]
+		}
+		if _, _, ok := windowsReservedBase(base); ok {
+			name = "_" + name
+			// The "_" prefix can push a name that was already at the byte
+			// limit one byte over, and re-truncating can in turn re-expose
+			// a trailing '.' or ' '; apply both steps once more. One more
+			// pass is enough, since the name now starts with "_" and can
+			// no longer match a reserved name.
+			name = truncateUTF8(name, maxSegmentBytes)
+			name = strings.TrimRight(name, ". ")
+		}
+	}
+
+	// A caller-supplied replacement rune can itself reconstruct a forbidden
+	// token, turning ".\x00" into ".." or injecting a '/' that splits one
+	// segment into two. Re-check the result the same way "", ".", and ".."
+	// are rejected on input, rather than relying on the rule-specific checks
+	// above to coincidentally absorb it.
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return "", true
+	}
+
+	return name, name != orig
+}
+
+// truncateUTF8 truncates s to at most n bytes, trimming back further if
+// necessary so the result never ends with a partial UTF-8 sequence.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for len(s) != 0 {
+		last, size := utf8.DecodeLastRuneInString(s)
+		if last != utf8.RuneError || size != 1 {
+			break
+		}
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// SanitizePath transforms path into a safe path under the receiver's rules,
+// using DefaultReplacement in place of disallowed bytes. It returns the
+// cleaned path and whether any change was made.
+//
+// Each segment is sanitized with SanitizePathSegment. Leading and trailing
+// slashes, repeated slashes, and segments that sanitize to "" are all
+// dropped, which has the effect of converting an absolute path to a
+// relative one.
+func (r Rules) SanitizePath(path string) (string, bool) {
+	return r.SanitizePathWith(path, DefaultReplacement)
+}
+
+// SanitizePathWith is like SanitizePath, but substitutes replacement for
+// disallowed bytes instead of DefaultReplacement.
+func (r Rules) SanitizePathWith(path string, replacement rune) (string, bool) {
+	parts := strings.Split(path, "/")
+	segs := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if seg, _ := r.SanitizePathSegmentWith(part, replacement); seg != "" {
+			segs = append(segs, seg)
+		}
+	}
+	clean := strings.Join(segs, "/")
+	return clean, clean != path
+}
+
+// isDriveLetter reports whether c is an ASCII letter, as used in a Windows
+// drive letter such as "C:".
+func isDriveLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// CheckArchiveEntry returns an error if name is not safe to extract from an
+// archive such as a zip or tar file.
+//
+// This applies CheckPath using the receiver's rules, which already rejects
+// absolute paths and ".." segments. On top of that, it rejects names
+// beginning with a drive letter such as "C:", which could be used as a
+// symlink target to escape the extraction directory, and segments
+// containing a colon, which on NTFS names an alternate data stream of the
+// preceding segment rather than a plain file.
+func (r Rules) CheckArchiveEntry(name string) error {
+	if err := r.CheckPath(name); err != nil {
+		return err
+	}
+	if len(name) >= 2 && name[1] == ':' && isDriveLetter(name[0]) {
+		return &Error{isPath: true, path: name, err: errDriveLetter}
+	}
+	rest := name
+	for len(rest) != 0 {
+		var part string
+		if i := strings.IndexByte(rest, '/'); i == -1 {
+			part, rest = rest, ""
+		} else {
+			part, rest = rest[:i], rest[i+1:]
+		}
+		if strings.IndexByte(part, ':') != -1 {
+			return &Error{isPath: true, path: name, name: part, err: errAltStream}
+		}
+	}
+	return nil
+}
+
+// CheckArchiveEntries returns an error if any name in names is unsafe
+// according to CheckArchiveEntry, if the same name is listed more than once,
+// if two distinct names are equal after conversion to lower case with
+// strings.ToLower (as in CheckPathSet), or if one name is a directory prefix
+// of another (compared in lower case, since
+// that is also a conflict on the case-insensitive filesystems CheckPathSet
+// defends against), meaning it would need to be both a file and a directory
+// when extracted.
+func (r Rules) CheckArchiveEntries(names []string) error {
+	type entry struct {
+		fold string
+		name string
+	}
+	entries := make([]entry, len(names))
+	for i, name := range names {
+		if err := r.CheckArchiveEntry(name); err != nil {
+			return err
+		}
+		entries[i] = entry{fold: strings.ToLower(name), name: name}
+	}
+
+	seen := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if other, ok := seen[e.fold]; ok {
+			if other == e.name {
+				return &Error{isPath: true, path: e.name, err: errDuplicate, other: other}
+			}
+			return &Error{isPath: true, path: e.name, err: errCaseCollision, other: other}
+		}
+		seen[e.fold] = e.name
+	}
+
+	// Sort by folded name so that every entry nested under a given folded
+	// prefix "dir/" occupies a single contiguous run, found with a binary
+	// search rather than a scan over every other entry.
+	sorted := append([]entry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].fold < sorted[j].fold })
+	for _, e := range entries {
+		prefix := e.fold + "/"
+		i := sort.Search(len(sorted), func(i int) bool { return sorted[i].fold >= prefix })
+		if i < len(sorted) && strings.HasPrefix(sorted[i].fold, prefix) {
+			return &Error{isPath: true, path: e.name, err: errParentChild, other: sorted[i].name}
+		}
+	}
+	return nil
+}
@@ -188,6 +188,331 @@ func TestWindowsReserved(t *testing.T) {
 	}
 }
 
+func TestWindowsReservedNormalized(t *testing.T) {
+	failcases := []string{
+		"com1 .txt",
+		"COM1 .TXT",
+		"lpt3  .dat",
+		"com¹",
+		"com²",
+		"com³.txt",
+		"lpt¹",
+		"LPT².log",
+	}
+	for _, c := range failcases {
+		if WindowsSafe.CheckPathSegment(c) == nil {
+			t.Errorf("path %q safe, expect error", c)
+		}
+	}
+	passcases := []string{
+		"com⁴", // superscript 4 is not a reserved digit
+		"commander.txt",
+	}
+	for _, c := range passcases {
+		if err := WindowsSafe.CheckPathSegment(c); err != nil {
+			t.Errorf("path %q: %v, expect ok", c, err)
+		}
+	}
+}
+
+func TestNormalizedUnicode(t *testing.T) {
+	failcases := []string{
+		"file\u200ename", // left-to-right mark (Cf)
+		"file\u202ename", // right-to-left override (bidi control)
+		"file\ue000name", // private use area (Co)
+		"\u0301accent",   // combining acute accent with no base (Mn)
+		"file^name",      // circumflex accent (Sk)
+		"e\u0301cafe",    // "e" + combining acute, not in NFC
+	}
+	for _, c := range failcases {
+		if NormalizedUnicode.CheckPathSegment(c) == nil {
+			t.Errorf("path %q safe, expect error", c)
+		}
+	}
+	passcases := []string{
+		"file.txt",
+		"caf\u00e9",    // precomposed "\u00e9", already NFC
+		"\u65e5\u672c", // Japanese text, ordinary letters
+	}
+	for _, c := range passcases {
+		if err := NormalizedUnicode.CheckPathSegment(c); err != nil {
+			t.Errorf("path %q: %v, expect ok", c, err)
+		}
+	}
+}
+
+func checkWLocalDeviceError(t *testing.T, r Rules, input string) {
+	t.Helper()
+	err := r.CheckPathSegment(input)
+	e, ok := err.(*Error)
+	if !ok || e.err != errWLocalDevice {
+		t.Errorf("%#v.CheckPathSegment(%q) = %v, want errWLocalDevice", r, input, err)
+	}
+}
+
+func TestWindowsLocal(t *testing.T) {
+	failcases := []string{
+		"?",
+		"??",
+	}
+	for _, c := range failcases {
+		checkWLocalDeviceError(t, WindowsLocal, c)
+		checkWLocalDeviceError(t, WindowsLocal|WindowsSafe, c)
+	}
+	checkWLocalDeviceError(t, WindowsLocal|WindowsSafe, `\\?\C:`)
+	// Without WindowsSafe, backslashes are ordinary characters.
+	if err := WindowsLocal.CheckPathSegment(`\\?\C:`); err != nil {
+		t.Errorf(`path %q: %v, expect ok`, `\\?\C:`, err)
+	}
+	passcases := []string{
+		"?question",
+		"a?b",
+		"normal.txt",
+	}
+	for _, c := range passcases {
+		if err := WindowsLocal.CheckPathSegment(c); err != nil {
+			t.Errorf("path %q: %v, expect ok", c, err)
+		}
+	}
+}
+
+func TestCheckPathSet(t *testing.T) {
+	passcases := [][]string{
+		nil,
+		{"a"},
+		{"a", "b", "c"},
+		{"dir/file.txt", "dir/File.txt.bak"},
+	}
+	for _, c := range passcases {
+		if err := Strict.CheckPathSet(c); err != nil {
+			t.Errorf("CheckPathSet(%q) = %v, expect ok", c, err)
+		}
+	}
+	failcases := [][]string{
+		{"a", "A"},
+		{"file.txt", "FILE.TXT"},
+		{"dir/file.txt", "dir/File.TXT"},
+		{"a", "b", "B"},
+	}
+	for _, c := range failcases {
+		if err := Strict.CheckPathSet(c); err == nil {
+			t.Errorf("CheckPathSet(%q) = nil, expect error", c)
+		}
+	}
+
+	// An exact duplicate is not a case-fold collision; it should be reported
+	// with its own error code rather than the misleading "case-insensitive
+	// collision" message.
+	err := Strict.CheckPathSet([]string{"dir/a.txt", "dir/a.txt"})
+	e, ok := err.(*Error)
+	if !ok || e.err != errDuplicate {
+		t.Errorf("CheckPathSet(duplicate) = %v, want errDuplicate", err)
+	}
+}
+
+func TestSanitizePathSegment(t *testing.T) {
+	type testcase struct {
+		rules  Rules
+		input  string
+		output string
+	}
+	cases := []testcase{
+		{Strict, "file.txt", "file.txt"},
+		{Strict, "", ""},
+		{Strict, ".", ""},
+		{Strict, "..", ""},
+		{Strict, "a/b", "a_b"},
+		{Strict, "a\x00b", "a_b"},
+		{Strict, ".hidden", "hidden"},
+		{ArgumentSafe, "-flag", "flag"},
+		{ShellSafe, "~user", "user"},
+		{WindowsSafe, "con", "_con"},
+		{WindowsSafe, "con.txt", "_con.txt"},
+		{WindowsSafe, "COM1 .txt", "_COM1 .txt"},
+		{WindowsSafe, "file.", "file"},
+		{WindowsSafe, "file ", "file"},
+		{Any, "normal", "normal"},
+	}
+	for _, c := range cases {
+		out, changed := c.rules.SanitizePathSegment(c.input)
+		if out != c.output {
+			t.Errorf("%#v.SanitizePathSegment(%q) = %q, want %q", c.rules, c.input, out, c.output)
+		}
+		wantChanged := c.input != c.output
+		if changed != wantChanged {
+			t.Errorf("%#v.SanitizePathSegment(%q) changed = %v, want %v", c.rules, c.input, changed, wantChanged)
+		}
+	}
+
+	long := strings.Repeat("x", 300)
+	out, changed := Strict.SanitizePathSegment(long)
+	if len(out) != 255 {
+		t.Errorf("SanitizePathSegment(long) has length %d, want 255", len(out))
+	}
+	if !changed {
+		t.Errorf("SanitizePathSegment(long) changed = false, want true")
+	}
+
+	// Truncating to maxSegmentBytes must not re-expose a trailing '.' or ' '
+	// that WindowsSafe already tried to strip: the sanitized output must
+	// itself pass CheckPathSegment under the same rules.
+	truncatedDot := strings.Repeat("x", 254) + ".png"
+	out, changed = WindowsSafe.SanitizePathSegment(truncatedDot)
+	if len(out) > 255 {
+		t.Errorf("SanitizePathSegment(truncatedDot) has length %d, want <= 255", len(out))
+	}
+	if !changed {
+		t.Errorf("SanitizePathSegment(truncatedDot) changed = false, want true")
+	}
+	if err := WindowsSafe.CheckPathSegment(out); err != nil {
+		t.Errorf("SanitizePathSegment(truncatedDot) = %q, not safe: %v", out, err)
+	}
+
+	if out, _ := Strict.SanitizePathSegmentWith("a/b", '-'); out != "a-b" {
+		t.Errorf("SanitizePathSegmentWith(%q, '-') = %q, want %q", "a/b", out, "a-b")
+	}
+
+	// A replacement rune that collides with a character already in the
+	// input can reconstruct a forbidden token, such as "." + "\x00" -> "..".
+	// The result must still be a safe segment, not just "changed" from the
+	// input.
+	reconstructCases := []struct {
+		rules       Rules
+		input       string
+		replacement rune
+	}{
+		{ASCIIOnly, ".\x00", '.'},
+		{ASCIIOnly, "a\x00b", '/'},
+	}
+	for _, c := range reconstructCases {
+		out, _ := c.rules.SanitizePathSegmentWith(c.input, c.replacement)
+		if out == "." || out == ".." || strings.ContainsAny(out, "/\x00") {
+			t.Errorf("%#v.SanitizePathSegmentWith(%q, %q) = %q, want a safe segment", c.rules, c.input, c.replacement, out)
+		}
+	}
+}
+
+func TestSanitizePath(t *testing.T) {
+	type testcase struct {
+		rules  Rules
+		input  string
+		output string
+	}
+	cases := []testcase{
+		{Strict, "a/b/c", "a/b/c"},
+		{Strict, "/a/b", "a/b"},
+		{Strict, "a/b/", "a/b"},
+		{Strict, "a//b", "a/b"},
+		{Strict, "a/./b", "a/b"},
+		{Strict, "a/../b", "a/b"},
+		{Strict, "", ""},
+		{Strict, "///", ""},
+	}
+	for _, c := range cases {
+		out, changed := c.rules.SanitizePath(c.input)
+		if out != c.output {
+			t.Errorf("%#v.SanitizePath(%q) = %q, want %q", c.rules, c.input, out, c.output)
+		}
+		wantChanged := c.input != c.output
+		if changed != wantChanged {
+			t.Errorf("%#v.SanitizePath(%q) changed = %v, want %v", c.rules, c.input, changed, wantChanged)
+		}
+	}
+
+	// A replacement rune must not let a segment reconstruct "..", producing
+	// a live traversal segment in the cleaned path.
+	if out, _ := ASCIIOnly.SanitizePathWith("x/.\x00/../secret", '.'); strings.Contains(out, "..") {
+		t.Errorf(`ASCIIOnly.SanitizePathWith("x/.\x00/../secret", '.') = %q, want no ".." segment`, out)
+	}
+}
+
+func TestCheckArchiveEntry(t *testing.T) {
+	passcases := []string{
+		"file.txt",
+		"dir/file.txt",
+		"a/b/c.txt",
+	}
+	for _, c := range passcases {
+		if err := Strict.CheckArchiveEntry(c); err != nil {
+			t.Errorf("CheckArchiveEntry(%q) = %v, expect ok", c, err)
+		}
+	}
+	failcases := []string{
+		"/etc/passwd",
+		"../escape",
+		"dir/../../escape",
+		"C:/Windows",
+		"c:windows",
+		"file.txt:hidden",
+		"dir/file.txt:hidden",
+	}
+	for _, c := range failcases {
+		if err := Strict.CheckArchiveEntry(c); err == nil {
+			t.Errorf("CheckArchiveEntry(%q) = nil, expect error", c)
+		}
+	}
+
+	// Under Strict, WindowsSafe and URLUnescaped already reject any colon
+	// via the generic disallowed-character scan in CheckPath, before
+	// CheckArchiveEntry's own drive-letter/alt-stream logic runs. Exercise
+	// that logic directly with a weaker rule set that allows colons.
+	driveLetterCases := []string{
+		"C:/Windows",
+		"c:windows",
+	}
+	for _, c := range driveLetterCases {
+		err := Any.CheckArchiveEntry(c)
+		e, ok := err.(*Error)
+		if !ok || e.err != errDriveLetter {
+			t.Errorf("Any.CheckArchiveEntry(%q) = %v, want errDriveLetter", c, err)
+		}
+	}
+	altStreamCases := []string{
+		"file.txt:hidden",
+		"dir/file.txt:hidden",
+	}
+	for _, c := range altStreamCases {
+		err := Any.CheckArchiveEntry(c)
+		e, ok := err.(*Error)
+		if !ok || e.err != errAltStream {
+			t.Errorf("Any.CheckArchiveEntry(%q) = %v, want errAltStream", c, err)
+		}
+	}
+}
+
+func TestCheckArchiveEntries(t *testing.T) {
+	passcases := [][]string{
+		nil,
+		{"a", "b", "c"},
+		{"dir/a.txt", "dir/b.txt"},
+	}
+	for _, c := range passcases {
+		if err := Strict.CheckArchiveEntries(c); err != nil {
+			t.Errorf("CheckArchiveEntries(%q) = %v, expect ok", c, err)
+		}
+	}
+	failcases := [][]string{
+		{"a", "A"},
+		{"file.txt", "FILE.TXT"},
+		{"a", "a/b"},
+		{"dir", "dir/file.txt"},
+		{"Dir", "dir/file.txt"},
+	}
+	for _, c := range failcases {
+		if err := Strict.CheckArchiveEntries(c); err == nil {
+			t.Errorf("CheckArchiveEntries(%q) = nil, expect error", c)
+		}
+	}
+
+	// An exact duplicate entry is not a case-fold collision; it should be
+	// reported with its own error code.
+	err := Strict.CheckArchiveEntries([]string{"dir/a.txt", "dir/a.txt"})
+	e, ok := err.(*Error)
+	if !ok || e.err != errDuplicate {
+		t.Errorf("CheckArchiveEntries(duplicate) = %v, want errDuplicate", err)
+	}
+}
+
 func TestSafepath(t *testing.T) {
 	allRules := []Rules{URLUnescaped, ShellSafe, ArgumentSafe, WindowsSafe, NotHidden, always}
 	type testcase struct {